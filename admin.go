@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var adminKey = flag.String("admin-key", "", "if non-empty, enables the /admin/ endpoints for requests bearing this key in an 'Authorization: Bearer' header")
+
+// admin serves the /admin/ endpoints.
+func admin(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		http.Error(w, "forbidden", 403)
+		return
+	}
+	switch r.URL.Path {
+	case "/admin/goenv":
+		adminGoEnv(w, r)
+	case "/admin/inflight":
+		adminInflight(w, r)
+	case "/admin/cancel":
+		adminCancel(w, r)
+	case "/admin/vars":
+		// Behind admin auth since it includes the command line.
+		expvar.Handler().ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func adminAuthorized(r *http.Request) bool {
+	if *adminKey == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	got := auth[len("Bearer "):]
+	return subtle.ConstantTimeCompare([]byte(got), []byte(*adminKey)) == 1
+}
+
+// adminGoEnv serves the effective "go env" that fetches of the
+// package named by the "pkg" parameter run with.
+func adminGoEnv(w http.ResponseWriter, r *http.Request) {
+	pkg := r.FormValue("pkg")
+	if !validPackagePath(pkg) {
+		http.Error(w, "missing or invalid pkg parameter", 400)
+		return
+	}
+	cmd := exec.Command("go", "env", "-json")
+	src, _ := packageRoot(pkg)
+	cmd.Env = fetchEnv(src)
+	out, err := cmd.Output()
+	if err != nil {
+		log.Printf("go env for %q failed: %v", pkg, err)
+		http.Error(w, fmt.Sprintf("Error running go env: %v", err), 500)
+		return
+	}
+	env := make(map[string]string)
+	if err := json.Unmarshal(out, &env); err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing go env output: %v", err), 500)
+		return
+	}
+	for k, v := range env {
+		env[k] = redactEnv(k, v)
+	}
+	serveJSON(w, r, func(int) interface{} { return env })
+}
+
+// An inflightFetch is a package being fetched, or waited on, as
+// listed by /admin/inflight.
+type inflightFetch struct {
+	Package string
+	Running bool       // go get is running
+	Started *time.Time `json:",omitempty"`
+	Seconds float64    `json:",omitempty"` // since Started
+	Clients []string   // fetching or waiting to
+}
+
+// adminInflight lists the packages in pending, which holds those with
+// someone fetching or waiting on them.
+func adminInflight(w http.ResponseWriter, r *http.Request) {
+	list := []inflightFetch{}
+	pendingMu.Lock()
+	for pkg, f := range pending {
+		in := inflightFetch{
+			Package: pkg,
+			Clients: append([]string(nil), f.clients...),
+		}
+		if !f.started.IsZero() {
+			started := f.started
+			in.Running = true
+			in.Started = &started
+			in.Seconds = time.Since(started).Seconds()
+		}
+		list = append(list, in)
+	}
+	pendingMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Package < list[j].Package })
+	serveJSON(w, r, func(int) interface{} { return list })
+}
+
+// adminCancel cancels fetching the package named by the "pkg"
+// parameter: its running go get is killed, and it and every client
+// waiting on it get an error rather than fetching again. The fetch
+// leaves pending at once, so later requests start a new one.
+func adminCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST required", 405)
+		return
+	}
+	pkg := r.FormValue("pkg")
+	pendingMu.Lock()
+	f, ok := pending[pkg]
+	var cancel func()
+	if ok {
+		if f.err == nil {
+			f.err = fmt.Errorf("Fetch of package %q canceled by an administrator", pkg)
+		}
+		cancel = f.cancel
+		delete(pending, pkg)
+	}
+	pendingMu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no fetch of %q is in flight", pkg), 404)
+		return
+	}
+	log.Printf("Canceling fetch of %q", pkg)
+	if cancel != nil {
+		cancel()
+	}
+	fmt.Fprintf(w, "canceled\n")
+}
+
+// validPackagePath reports whether pkg is a clean, relative import
+// path that can't name anything outside a GOPATH src directory.
+func validPackagePath(pkg string) bool {
+	if pkg == "" || path.Clean(pkg) != pkg || strings.HasPrefix(pkg, "/") {
+		return false
+	}
+	for _, elem := range strings.Split(pkg, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// redactEnv returns v with anything that looks like a credential
+// removed: the whole value of secret-sounding variables, and any URL
+// userinfo elsewhere.
+func redactEnv(k, v string) string {
+	if v == "" {
+		return v
+	}
+	uk := strings.ToUpper(k)
+	for _, s := range []string{"TOKEN", "SECRET", "PASSWORD", "GOAUTH"} {
+		if strings.Contains(uk, s) {
+			return "REDACTED"
+		}
+	}
+	// Lists like GOPROXY are separated by commas or pipes.
+	parts := strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '|' })
+	for _, p := range parts {
+		u, err := url.Parse(p)
+		if err != nil || u.User == nil {
+			continue
+		}
+		// Tokens are often passed as the username alone, so
+		// hide the whole userinfo.
+		u.User = url.User("xxxxx")
+		v = strings.Replace(v, p, u.String(), 1)
+	}
+	return v
+}
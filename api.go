@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// JSON responses are versioned by media type. A client pins a
+// version with "Accept: application/vnd.go-get-proxy.vN+json";
+// any other Accept (or none) gets the latest version. Shapes only
+// change incompatibly in a new version, and old versions are kept
+// in supportedAPIVersions until their clients are gone.
+const (
+	apiMediaPrefix   = "application/vnd.go-get-proxy.v"
+	apiMediaSuffix   = "+json"
+	latestAPIVersion = 1
+)
+
+var supportedAPIVersions = map[int]bool{1: true}
+
+// apiVersion returns the JSON API version to answer r with, or
+// ok=false if r only accepts versions this proxy doesn't speak. A
+// client that pins only unsupported versions but also accepts plain
+// JSON gets the latest version.
+func apiVersion(r *http.Request) (version int, ok bool) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return latestAPIVersion, true
+	}
+	pinned, generic := false, false
+	for _, mr := range strings.Split(accept, ",") {
+		mt := strings.TrimSpace(mr)
+		if i := strings.Index(mt, ";"); i >= 0 {
+			mt = strings.TrimSpace(mt[:i])
+		}
+		switch mt {
+		case "application/json", "application/*", "*/*":
+			generic = true
+		}
+		if !strings.HasPrefix(mt, apiMediaPrefix) || !strings.HasSuffix(mt, apiMediaSuffix) {
+			continue
+		}
+		pinned = true
+		v, err := strconv.Atoi(mt[len(apiMediaPrefix) : len(mt)-len(apiMediaSuffix)])
+		if err == nil && supportedAPIVersions[v] {
+			return v, true
+		}
+	}
+	if pinned && !generic {
+		return 0, false
+	}
+	return latestAPIVersion, true
+}
+
+// apiMediaType returns the media type of JSON API version v.
+func apiMediaType(v int) string {
+	return apiMediaPrefix + strconv.Itoa(v) + apiMediaSuffix
+}
+
+// serveJSON writes the JSON response to r, negotiating the
+// API version. The shape function returns the value to encode for
+// the negotiated version.
+func serveJSON(w http.ResponseWriter, r *http.Request, shape func(version int) interface{}) {
+	ver, ok := apiVersion(r)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported API version; latest is %s", apiMediaType(latestAPIVersion)), http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", apiMediaType(ver))
+	w.Header().Add("Vary", "Accept")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(shape(ver))
+}
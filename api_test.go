@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIVersion(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   int
+		ok     bool
+	}{
+		{"", 1, true},
+		{"*/*", 1, true},
+		{"application/json", 1, true},
+		{"text/html", 1, true},
+		{"application/vnd.go-get-proxy.v1+json", 1, true},
+		{"application/vnd.go-get-proxy.v1+json; charset=utf-8", 1, true},
+		{"application/vnd.go-get-proxy.v1+json;q=0.9, text/html", 1, true},
+		{"application/vnd.go-get-proxy.v2+json", 0, false},
+		{"application/vnd.go-get-proxy.vx+json", 0, false},
+		{"application/vnd.go-get-proxy.v2+json, application/vnd.go-get-proxy.v1+json", 1, true},
+		{"application/vnd.go-get-proxy.v2+json, application/json", 1, true},
+		{"application/vnd.go-get-proxy.v2+json, text/html", 0, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/admin/goenv", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		got, ok := apiVersion(r)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Accept %q: apiVersion = %v, %v; want %v, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestServeJSON(t *testing.T) {
+	serve := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/admin/goenv", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		serveJSON(w, r, func(int) interface{} { return map[string]int{"a": 1} })
+		return w
+	}
+	w := serve("application/json")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/vnd.go-get-proxy.v1+json" {
+		t.Errorf("got %d, Content-Type %q; want 200, v1 media type", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w := serve("application/vnd.go-get-proxy.v2+json"); w.Code != http.StatusNotAcceptable {
+		t.Errorf("v2 only: got %d; want 406", w.Code)
+	}
+}
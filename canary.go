@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	canaryPackage  = flag.String("canary-package", "", "if non-empty, a known-good package periodically fetched and tarred end-to-end; /readyz fails while it fails")
+	canaryInterval = flag.Duration("canary-interval", 5*time.Minute, "how often to run the -canary-package check")
+	canaryTimeout  = flag.Duration("canary-timeout", 2*time.Minute, "maximum run time of a -canary-package check, after which it fails")
+)
+
+// canaryResult is the outcome of the most recent canary run.
+type canaryResult struct {
+	Package  string
+	Time     time.Time
+	Duration time.Duration
+	Error    string `json:",omitempty"`
+}
+
+var (
+	canaryMu   sync.Mutex
+	lastCanary *canaryResult // nil until the first run finishes
+)
+
+func init() {
+	expvar.Publish("canary", expvar.Func(func() interface{} {
+		canaryMu.Lock()
+		defer canaryMu.Unlock()
+		return lastCanary
+	}))
+}
+
+// runCanaries runs the canary check every -canary-interval, forever.
+func runCanaries() {
+	for {
+		res := runCanary(*canaryPackage)
+		if res.Error != "" {
+			log.Printf("Canary %q failed: %s", res.Package, res.Error)
+		}
+		canaryMu.Lock()
+		lastCanary = res
+		canaryMu.Unlock()
+		time.Sleep(*canaryInterval)
+	}
+}
+
+// runCanary fetches pkg and tars it the way downloads are served,
+// giving up after -canary-timeout.
+func runCanary(pkg string) *canaryResult {
+	res := &canaryResult{Package: pkg, Time: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), *canaryTimeout)
+	defer cancel()
+	path, err := getPackage(ctx, pkg, "canary")
+	if err == nil {
+		if *compressorCmd != "" {
+			err = makeTarCmd(ctx, ioutil.Discard, path)
+		} else {
+			err = makeTar(ioutil.Discard, path, *gzipLevel)
+		}
+	}
+	res.Duration = time.Since(res.Time)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// readyz reports whether the proxy should get traffic: always, if
+// no canary is configured, and otherwise only while the last canary
+// run succeeded and is recent. Runs start at most -canary-interval
+// plus -canary-timeout apart, so a result older than twice that
+// means the canary loop itself is stuck.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if *canaryPackage == "" {
+		fmt.Fprintf(w, "ok\n")
+		return
+	}
+	canaryMu.Lock()
+	res := lastCanary
+	canaryMu.Unlock()
+	switch {
+	case res == nil:
+		http.Error(w, "canary has not run yet", 503)
+	case res.Error != "":
+		http.Error(w, fmt.Sprintf("canary %q failed at %v: %s", res.Package, res.Time.Format(time.RFC3339), res.Error), 503)
+	case time.Since(res.Time) > 2*(*canaryInterval+*canaryTimeout):
+		http.Error(w, fmt.Sprintf("canary %q last ran at %v", res.Package, res.Time.Format(time.RFC3339)), 503)
+	default:
+		fmt.Fprintf(w, "ok\n")
+	}
+}
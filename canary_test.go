@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGo puts a "go" command running script first in PATH for the
+// duration of the test.
+func fakeGo(t *testing.T, script string) {
+	t.Helper()
+	bin := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(bin, "go"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestCanaryTimeout(t *testing.T) {
+	testGOPATH(t, 1)
+	fakeGo(t, "exec sleep 60\n")
+	setFlag(t, "canary-timeout", "200ms")
+
+	start := time.Now()
+	res := runCanary("ex/blackhole")
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("canary took %v; want it cut off near -canary-timeout", d)
+	}
+	if res.Error == "" {
+		t.Error("hung canary succeeded")
+	}
+}
+
+func TestCanaryUsesCompressor(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	freshPackage(t, src, "ex/p", map[string]string{"p.go": "package p\n"})
+	if res := runCanary("ex/p"); res.Error != "" {
+		t.Fatalf("canary failed: %s", res.Error)
+	}
+	setFlag(t, "compressor-cmd", "false")
+	if res := runCanary("ex/p"); res.Error == "" {
+		t.Error("canary passed with a failing -compressor-cmd")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	setFlag(t, "canary-package", "ex/p")
+	setFlag(t, "canary-interval", "1m")
+	setFlag(t, "canary-timeout", "1m")
+	old := lastCanary
+	t.Cleanup(func() { lastCanary = old })
+
+	tests := []struct {
+		res  *canaryResult
+		want int
+	}{
+		{nil, 503},
+		{&canaryResult{Package: "ex/p", Time: time.Now()}, 200},
+		{&canaryResult{Package: "ex/p", Time: time.Now(), Error: "boom"}, 503},
+		{&canaryResult{Package: "ex/p", Time: time.Now().Add(-3 * time.Minute)}, 200},
+		{&canaryResult{Package: "ex/p", Time: time.Now().Add(-5 * time.Minute)}, 503},
+	}
+	for i, tt := range tests {
+		lastCanary = tt.res
+		w := httptest.NewRecorder()
+		readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		if w.Code != tt.want {
+			t.Errorf("%d: got %d (%s); want %d", i, w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+		}
+	}
+}
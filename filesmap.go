@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var filesMapMax = flag.Int64("filesmap-max-size", 1<<20, "maximum total size of a package served with ?format=filesmap")
+
+// vcsFiles are VCS metadata files left out of ?format=filesmap.
+var vcsFiles = map[string]bool{
+	".gitignore":     true,
+	".gitattributes": true,
+	".gitmodules":    true,
+	".hgignore":      true,
+	".hgtags":        true,
+	".hgsub":         true,
+	".hgsubstate":    true,
+	".bzrignore":     true,
+}
+
+// serveFilesMap serves the package in dir as a JSON object mapping
+// each file's name to its base64-encoded contents, for clients that
+// can't unpack a tar. VCS metadata files are left out.
+func serveFilesMap(w http.ResponseWriter, r *http.Request, dir string) {
+	files, err := packageFiles(dir)
+	if err == errTooManyEntries {
+		http.Error(w, fmt.Sprintf("package has more than %d files", *maxTarEntries), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	var total int64
+	for _, f := range files {
+		total += f.fi.Size()
+	}
+	if total > *filesMapMax {
+		http.Error(w, fmt.Sprintf("package is %d bytes; ?format=filesmap is limited to %d", total, *filesMapMax), http.StatusRequestEntityTooLarge)
+		return
+	}
+	m := make(map[string][]byte, len(files)) // encoded as base64
+	for _, f := range files {
+		if f.fi.Mode()&os.ModeType != 0 || vcsFiles[f.name] {
+			continue
+		}
+		body, err := readPackageFile(f.path)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		m[f.name] = body
+	}
+	serveJSON(w, r, func(int) interface{} { return m })
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilesMap(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	dir := freshPackage(t, src, "ex/p", map[string]string{
+		"a.go":           "package p\n",
+		"b.bin":          "\x00\x01\xff\xfe",
+		"README":         "hi\n",
+		".gitignore":     "*.o\n",
+		".gitattributes": "* text=auto\n",
+		".hgtags":        "abc v1\n",
+		"sub/c.go":       "package sub\n",
+	})
+
+	w := get(t, "/ex/p?format=filesmap")
+	if w.Code != 200 {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	var m map[string][]byte // base64 decoded by encoding/json
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.go", "b.bin", "README"}
+	if len(m) != len(want) {
+		t.Errorf("got files %v; want %v", keys(m), want)
+	}
+	for _, name := range want {
+		disk, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := m[name]; !ok || string(got) != string(disk) {
+			t.Errorf("%s = %q; want %q", name, got, disk)
+		}
+	}
+}
+
+func TestFilesMapTooLarge(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	freshPackage(t, src, "ex/p", map[string]string{"a.go": "package p\n"})
+	setFlag(t, "filesmap-max-size", "5")
+	if w := get(t, "/ex/p?format=filesmap"); w.Code != 413 {
+		t.Errorf("got %d; want 413", w.Code)
+	}
+}
+
+func keys(m map[string][]byte) []string {
+	var ks []string
+	for k := range m {
+		ks = append(ks, k)
+	}
+	return ks
+}
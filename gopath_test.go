@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSrcDirs(t *testing.T) {
+	sep := string(filepath.ListSeparator)
+	tests := []struct {
+		gopath string
+		want   []string
+	}{
+		{"", []string{"src"}},
+		{"/a", []string{"/a/src"}},
+		{"/a" + sep + "/b", []string{"/a/src", "/b/src"}},
+		{"/a" + sep + sep + "/b" + sep, []string{"/a/src", "/b/src"}},
+		{sep, []string{"src"}},
+	}
+	for _, tt := range tests {
+		if got := srcDirs(tt.gopath); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("srcDirs(%q) = %q; want %q", tt.gopath, got, tt.want)
+		}
+	}
+}
+
+// stalePackage creates pkg under src, fetched long ago.
+func stalePackage(t *testing.T, src, pkg string) string {
+	t.Helper()
+	dir := freshPackage(t, src, pkg, map[string]string{"p.go": "package p // " + src + "\n"})
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, modtimeFile), old, old); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestPackageRoot(t *testing.T) {
+	srcs := testGOPATH(t, 3)
+	fresh := func(i int, pkg string) { freshPackage(t, srcs[i], pkg, map[string]string{"p.go": "package p\n"}) }
+	stale := func(i int, pkg string) { stalePackage(t, srcs[i], pkg) }
+
+	stale(0, "ex/a") // stale mirror, fresh cache
+	fresh(1, "ex/a")
+	stale(1, "ex/b") // only in a later root
+	stale(0, "ex/c") // stale everywhere
+	stale(2, "ex/c")
+	fresh(1, "ex/d") // fresh in two roots
+	fresh(2, "ex/d")
+
+	tests := []struct {
+		pkg         string
+		order, fres int // index of the src chosen in each mode
+	}{
+		{"ex/a", 0, 1},
+		{"ex/b", 1, 1},
+		{"ex/c", 0, 0},
+		{"ex/d", 1, 1},
+		{"ex/none", 0, 0},
+	}
+	for _, tt := range tests {
+		for mode, want := range map[string]int{"order": tt.order, "fresh": tt.fres} {
+			setFlag(t, "gopath-precedence", mode)
+			src, dir := packageRoot(tt.pkg)
+			if src != srcs[want] || dir != filepath.Join(srcs[want], filepath.FromSlash(tt.pkg)) {
+				t.Errorf("%s, %s: packageRoot = %q, %q; want src %d", tt.pkg, mode, src, dir, want)
+			}
+		}
+	}
+}
+
+func TestFetchEnvGOPATH(t *testing.T) {
+	srcs := testGOPATH(t, 3)
+	gopath := func(src string) string {
+		for _, kv := range fetchEnv(src) {
+			if strings.HasPrefix(kv, "GOPATH=") {
+				return kv[len("GOPATH="):]
+			}
+		}
+		return ""
+	}
+	roots := func(is ...int) string {
+		var s []string
+		for _, i := range is {
+			s = append(s, filepath.Dir(srcs[i]))
+		}
+		return strings.Join(s, string(filepath.ListSeparator))
+	}
+	if got, want := gopath(srcs[0]), roots(0, 1, 2); got != want {
+		t.Errorf("first root: GOPATH=%q; want %q", got, want)
+	}
+	if got, want := gopath(srcs[2]), roots(2, 0, 1); got != want {
+		t.Errorf("last root: GOPATH=%q; want %q", got, want)
+	}
+}
+
+// TestMultiGOPATHServe checks that what's served, what's fetched
+// into, and what's marked fresh all agree, with the package in two
+// roots of differing freshness.
+func TestMultiGOPATHServe(t *testing.T) {
+	srcs := testGOPATH(t, 2)
+	log := filepath.Join(t.TempDir(), "gopath")
+	fakeGo(t, `echo "$GOPATH" > `+log+"\n")
+	setFlag(t, "gopath-precedence", "fresh")
+
+	// body returns the served p.go.
+	body := func(url string) string {
+		t.Helper()
+		w := get(t, url+"?format=filesmap")
+		if w.Code != 200 {
+			t.Fatalf("%s: got %d: %s", url, w.Code, w.Body)
+		}
+		var m map[string][]byte
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		return string(m["p.go"])
+	}
+
+	// Fresh in the second root: served from there, no fetch.
+	mirror := stalePackage(t, srcs[0], "ex/a")
+	os.Mkdir(filepath.Join(mirror, ".git"), 0755)
+	freshPackage(t, srcs[1], "ex/a", map[string]string{"p.go": "package p // cache\n"})
+	if b := body("/ex/a"); b != "package p // cache\n" {
+		t.Errorf("served %q; want the fresh copy", b)
+	}
+	if _, err := os.Stat(log); err == nil {
+		t.Error("fetched although a fresh copy existed")
+	}
+
+	// Stale in both: fetched into, marked in, and served from the
+	// first root.
+	stalePackage(t, srcs[0], "ex/b")
+	os.Mkdir(filepath.Join(srcs[0], "ex", "b", ".git"), 0755)
+	stalePackage(t, srcs[1], "ex/b")
+	if b, want := body("/ex/b"), "package p // "+srcs[0]+"\n"; b != want {
+		t.Errorf("served %q; want %q", b, want)
+	}
+	got, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal("no fetch ran")
+	}
+	if !strings.HasPrefix(string(got), filepath.Dir(srcs[0])+string(filepath.ListSeparator)) {
+		t.Errorf("fetched with GOPATH=%q; want %s first", got, filepath.Dir(srcs[0]))
+	}
+	if !isNewEnough(srcs[0], filepath.Join(srcs[0], "ex", "b")) {
+		t.Error("fetched copy not marked fresh")
+	}
+	if isNewEnough(srcs[1], filepath.Join(srcs[1], "ex", "b")) {
+		t.Error("other root's copy marked fresh")
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -20,21 +23,129 @@ import (
 
 const modtimeFile = ".go-get-proxy-last"
 
+// versionFile holds the pseudo-version of the fetched checkout, if it
+// has one, next to each modtimeFile.
+const versionFile = ".go-get-proxy-version"
+
 var (
-	listen = flag.String("listen", ":8080", "port, ip:port, or 'envfd:NAME' to listen on")
+	listen           = flag.String("listen", ":8080", "port, ip:port, or 'envfd:NAME' to listen on")
+	maxDownloads     = flag.Int("max-downloads", 0, "maximum number of tars served concurrently, independent of fetches; 0 means no limit")
+	packageShare     = flag.Float64("max-package-share", 1, "maximum fraction of -max-downloads that downloads of any one package may hold")
+	gopathPrecedence = flag.String("gopath-precedence", "order", "with several GOPATH entries, which copy of a package to serve and update: the one in the first entry holding it ('order'), or the first new enough one, falling back to 'order' ('fresh')")
+	caseMismatch     = flag.String("case-mismatch", "serve", "when a package's directory differs in case from the request: 'serve' it with a Warning header, or 'error'")
 )
 
 var (
 	pendingMu sync.Mutex
-	pending   = make(map[string]chan bool)
+	pending   = make(map[string]*fetch)
 )
 
+// A fetch tracks the fetching of one package. Its fields other than
+// c are guarded by pendingMu.
+type fetch struct {
+	c       chan bool          // buffer of 1; held while go get runs
+	clients []string           // fetching or waiting to
+	started time.Time          // zero unless go get is running
+	cancel  context.CancelFunc // kills the running go get
+	err     error              // if non-nil, canceled; all its clients get this
+}
+
+// downloadSem bounds concurrent tar streams. It's nil if
+// -max-downloads is 0.
+var downloadSem chan bool
+
+var (
+	activeFetches     = expvar.NewInt("fetches_active")
+	activeDownloads   = expvar.NewInt("downloads_active")
+	rejectedDownloads = expvar.NewInt("downloads_rejected")
+)
+
+// Per-package load, published as expvars. Zero counts are removed
+// so the maps only hold packages with something in flight.
+var (
+	loadMu          sync.Mutex
+	pkgDownloads    = make(map[string]int) // tars being served
+	pkgFetches      = make(map[string]int) // go get running (0 or 1)
+	pkgFetchWaiters = make(map[string]int) // waiting on another fetch
+)
+
+func addLoad(m map[string]int, pkg string, delta int) {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+	m[pkg] += delta
+	if m[pkg] <= 0 {
+		delete(m, pkg)
+	}
+}
+
+func publishLoad(name string, m map[string]int) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		loadMu.Lock()
+		defer loadMu.Unlock()
+		c := make(map[string]int, len(m))
+		for k, v := range m {
+			c[k] = v
+		}
+		return c
+	}))
+}
+
+// acquireDownload reserves a download slot for pkg, returning
+// ok=false if either all slots are in use or pkg already holds its
+// -max-package-share of them. Fetches need no such check: the
+// pending lock admits one fetch per package, and its waiters hold
+// nothing while they wait.
+func acquireDownload(pkg string) (release func(), ok bool) {
+	if downloadSem == nil {
+		addLoad(pkgDownloads, pkg, 1)
+		return func() { addLoad(pkgDownloads, pkg, -1) }, true
+	}
+	loadMu.Lock()
+	if pkgDownloads[pkg] >= packageDownloadLimit() {
+		loadMu.Unlock()
+		return nil, false
+	}
+	select {
+	case downloadSem <- true:
+	default:
+		loadMu.Unlock()
+		return nil, false
+	}
+	pkgDownloads[pkg]++
+	loadMu.Unlock()
+	return func() {
+		addLoad(pkgDownloads, pkg, -1)
+		<-downloadSem
+	}, true
+}
+
+// packageDownloadLimit returns how many download slots one package
+// may hold. Every package gets at least one, unless downloads are
+// unlimited, in which case it returns 0.
+func packageDownloadLimit() int {
+	if downloadSem == nil {
+		return 0
+	}
+	n := int(*packageShare * float64(*maxDownloads))
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
 func proxy(w http.ResponseWriter, r *http.Request) {
 	upath := r.URL.Path
 	switch upath {
 	case "/favicon.ico", "/robots.txt":
 		// TODO(brafitz): handle
 		return
+	case "/readyz":
+		readyz(w, r)
+		return
+	}
+	if strings.HasPrefix(upath, "/admin/") {
+		admin(w, r)
+		return
 	}
 	if len(upath) < 2 {
 		fmt.Fprintf(w, "<html><body>go get proxy</body></html>")
@@ -55,29 +166,97 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 		file = ""
 	}
 
-	path, err := getPackage(pkg)
+	format := r.FormValue("format")
+	switch format {
+	case "", "tar", "filesmap":
+	default:
+		http.Error(w, "unknown format", 400)
+		return
+	}
+
+	level := *gzipLevel
+	if v := r.FormValue("clevel"); v != "" {
+		if *compressorCmd != "" {
+			http.Error(w, "clevel is not supported with this proxy's external compressor", 400)
+			return
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid clevel parameter", 400)
+			return
+		}
+		level = clampGzipLevel(n)
+	}
+
+	// Not r.Context(): a fetch left behind by one client that goes
+	// away is still wanted by the next.
+	path, err := getPackage(context.Background(), pkg, r.RemoteAddr)
 	if err != nil {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		fmt.Fprint(w, err.Error())
 		return
 	}
+	if canon := importPath(path); canon != "" && canon != pkg {
+		if *caseMismatch == "error" {
+			http.Error(w, fmt.Sprintf("package %q is stored as %q; request it with that casing", pkg, canon), 404)
+			return
+		}
+		w.Header().Set("Warning", fmt.Sprintf("299 - %q", "package fetched as "+canon))
+	}
+	if pv, err := ioutil.ReadFile(filepath.Join(path, versionFile)); err == nil && len(pv) > 0 {
+		w.Header().Set("X-Pseudo-Version", string(pv))
+	}
 
 	switch {
 	case file == "":
 		// Tar mode.
+		release, ok := acquireDownload(pkg)
+		if !ok {
+			rejectedDownloads.Add(1)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent downloads", 503)
+			return
+		}
+		defer release()
+		activeDownloads.Add(1)
+		defer activeDownloads.Add(-1)
+		if format == "filesmap" {
+			serveFilesMap(w, r, path)
+			return
+		}
 		w.Header().Set("Content-Type", "application/x-tar")
-		err = makeTar(w, path)
+		ww := &writeWatcher{w: w}
+		if *compressorCmd != "" {
+			if *compressorContentType != "" {
+				w.Header().Set("Content-Type", *compressorContentType)
+			}
+			if *compressorEncoding != "" {
+				w.Header().Set("Content-Encoding", *compressorEncoding)
+			}
+			err = makeTarCmd(r.Context(), ww, path)
+		} else {
+			err = makeTar(ww, path, level)
+		}
 		if err != nil {
 			log.Printf("Error generating tar of %q: %v", path, err)
 		}
+		if err != nil && !ww.wrote {
+			// Nothing sent yet, so the client can be told.
+			w.Header().Del("Content-Encoding")
+			if err == errTooManyEntries {
+				http.Error(w, fmt.Sprintf("package has more than %d files", *maxTarEntries), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, err.Error(), 500)
+			}
+		}
 		return
 	default:
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		f, err := os.Open(filepath.Join(path, file))
 		if err != nil {
 			w.WriteHeader(500)
-			fmt.Fprintf(w, err.Error())
+			fmt.Fprint(w, err.Error())
 			return
 		}
 		defer f.Close()
@@ -85,12 +264,41 @@ func proxy(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-var goPathSrc = filepath.Join(os.Getenv("GOPATH"), "src")
+// writeWatcher records whether anything was written to w.
+type writeWatcher struct {
+	w     io.Writer
+	wrote bool
+}
+
+func (ww *writeWatcher) Write(p []byte) (int, error) {
+	ww.wrote = true
+	return ww.w.Write(p)
+}
+
+// goPathSrcs are the src directories of each GOPATH entry, in order.
+var goPathSrcs = srcDirs(os.Getenv("GOPATH"))
+
+func srcDirs(gopath string) []string {
+	var srcs []string
+	for _, p := range filepath.SplitList(gopath) {
+		if p == "" {
+			// Like the go tool, ignore empty entries.
+			continue
+		}
+		srcs = append(srcs, filepath.Join(p, "src"))
+	}
+	if len(srcs) == 0 {
+		srcs = []string{"src"}
+	}
+	return srcs
+}
 
 const newEnough = 1 * time.Minute
 
-func isNewEnough(dir string) (ret bool) {
-	for len(dir) > len(goPathSrc) {
+// isNewEnough reports whether dir, under the GOPATH src directory
+// src, or any of its parents below src was fetched recently.
+func isNewEnough(src, dir string) (ret bool) {
+	for len(dir) > len(src) {
 		if fi, err := os.Stat(filepath.Join(dir, modtimeFile)); err == nil {
 			if time.Now().Sub(fi.ModTime()) < newEnough {
 				log.Printf("Dir %s is new enough.", dir)
@@ -102,9 +310,91 @@ func isNewEnough(dir string) (ret bool) {
 	return false
 }
 
-func getPackage(pkg string) (pkgPath string, err error) {
-	pkgPath = filepath.Join(goPathSrc, filepath.FromSlash(pkg))
-	if isNewEnough(pkgPath) {
+// packageRoot returns which GOPATH src directory pkg is served from
+// and fetched into, and pkg's directory there. With
+// -gopath-precedence=order that's the first src directory holding
+// pkg, as the go tool itself would pick; "fresh" first prefers the
+// first one holding a new enough copy. If no src directory holds pkg,
+// it's the first.
+func packageRoot(pkg string) (src, pkgPath string) {
+	if *gopathPrecedence == "fresh" {
+		for _, src := range goPathSrcs {
+			p := locatePackage(src, pkg)
+			if isNewEnough(src, p) {
+				return src, p
+			}
+		}
+	}
+	for _, src := range goPathSrcs {
+		p := locatePackage(src, pkg)
+		if _, err := os.Stat(p); err == nil {
+			return src, p
+		}
+	}
+	return goPathSrcs[0], locatePackage(goPathSrcs[0], pkg)
+}
+
+// importPath returns the import path of the package in dir, or "" if
+// dir isn't under any GOPATH src directory.
+func importPath(dir string) string {
+	for _, src := range goPathSrcs {
+		rel, err := filepath.Rel(src, dir)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return ""
+}
+
+// locatePackage returns the directory of pkg under the GOPATH src
+// directory src. If there's no exact match but a directory differing
+// only in case exists, as a host that's case-insensitive about import
+// paths can leave behind, that's returned instead.
+func locatePackage(src, pkg string) string {
+	exact := filepath.Join(src, filepath.FromSlash(pkg))
+	if _, err := os.Stat(exact); err == nil {
+		return exact
+	}
+	if dir, ok := locateFold(src, strings.Split(pkg, "/")); ok {
+		return dir
+	}
+	return exact
+}
+
+// locateFold finds the directory under dir whose path elements match
+// elems case-insensitively, preferring exact matches. Several entries
+// of a directory may match an element, so each is tried in turn.
+func locateFold(dir string, elems []string) (string, bool) {
+	if len(elems) == 0 {
+		return dir, true
+	}
+	elem := elems[0]
+	if fi, err := os.Stat(filepath.Join(dir, elem)); err == nil && fi.IsDir() {
+		if found, ok := locateFold(filepath.Join(dir, elem), elems[1:]); ok {
+			return found, true
+		}
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, fi := range fis {
+		if fi.IsDir() && fi.Name() != elem && strings.EqualFold(fi.Name(), elem) {
+			if found, ok := locateFold(filepath.Join(dir, fi.Name()), elems[1:]); ok {
+				return found, true
+			}
+		}
+	}
+	return "", false
+}
+
+// getPackage fetches pkg, if it's not new enough already, and returns
+// its directory. client identifies the requester in /admin/inflight.
+// If ctx is done first, getPackage stops waiting for another fetch of
+// pkg, or kills its own.
+func getPackage(ctx context.Context, pkg, client string) (pkgPath string, err error) {
+	src, pkgPath := packageRoot(pkg)
+	if isNewEnough(src, pkgPath) {
 		return
 	}
 
@@ -113,19 +403,72 @@ func getPackage(pkg string) (pkgPath string, err error) {
 	// only protecting the top level. the go get tool will go
 	// fetch dependencies that we don't see here.
 	pendingMu.Lock()
-	c, ok := pending[pkg]
+	f, ok := pending[pkg]
 	if !ok {
-		c = make(chan bool, 1)
-		pending[pkg] = c
+		f = &fetch{c: make(chan bool, 1)}
+		pending[pkg] = f
 	}
+	f.clients = append(f.clients, client)
 	pendingMu.Unlock()
-	c <- true // blocks until buffer size of 1 is free
-	defer func() { <-c }()
+	defer func() {
+		pendingMu.Lock()
+		defer pendingMu.Unlock()
+		for i, c := range f.clients {
+			if c == client {
+				f.clients = append(f.clients[:i], f.clients[i+1:]...)
+				break
+			}
+		}
+		// The last client out removes the entry, unless a
+		// cancel already has.
+		if len(f.clients) == 0 && pending[pkg] == f {
+			delete(pending, pkg)
+		}
+	}()
+	addLoad(pkgFetchWaiters, pkg, 1)
+	select {
+	case f.c <- true: // blocks until buffer size of 1 is free
+	case <-ctx.Done():
+		addLoad(pkgFetchWaiters, pkg, -1)
+		return "", fmt.Errorf("Gave up waiting to fetch package %q: %v", pkg, ctx.Err())
+	}
+	addLoad(pkgFetchWaiters, pkg, -1)
+	defer func() { <-f.c }()
+
+	// Check for cancellation and publish cancel together, so an
+	// admin cancel either stops us here or kills the command.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pendingMu.Lock()
+	err = f.err
+	if err == nil {
+		f.started, f.cancel = time.Now(), cancel
+	}
+	pendingMu.Unlock()
+	if err != nil {
+		return "", err
+	}
 
 	log.Printf("Getting package %q...", pkg)
-	cmd := exec.Command("go", "get", "-u", "-d", pkg)
+	cmd := exec.CommandContext(ctx, "go", "get", "-u", "-d", pkg)
+	// The same src as pkgPath, even if another root has become
+	// fresher while we waited, so go get updates the copy we serve.
+	cmd.Env = fetchEnv(src)
+	// Once canceled, don't wait for VCS subprocesses still holding
+	// the output pipe.
+	cmd.WaitDelay = 5 * time.Second
 
+	activeFetches.Add(1)
+	addLoad(pkgFetches, pkg, 1)
 	out, err := cmd.CombinedOutput()
+	addLoad(pkgFetches, pkg, -1)
+	activeFetches.Add(-1)
+	pendingMu.Lock()
+	f.started, f.cancel = time.Time{}, nil
+	if f.err != nil {
+		err = f.err
+	}
+	pendingMu.Unlock()
 	if err != nil {
 		// TODO: set a global "last failure time" for this package (or up a level),
 		// so some expensive failure can't happen often quickly.
@@ -134,10 +477,66 @@ func getPackage(pkg string) (pkgPath string, err error) {
 	}
 
 	log.Printf("Fetched package %q", pkg)
+	pkgPath = locatePackage(src, pkg)
+
+	root, vcs, err := vcsRoot(pkgPath)
+	if err != nil {
+		return "", err
+	}
+	pv := pseudoVersion(root, vcs)
+
+	log.Printf("root of %q is: %q", pkg, root)
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		switch filepath.Base(path) {
+		case ".svn", ".hg", ".git", ".bzr":
+			return filepath.SkipDir
+		}
+		tf := filepath.Join(path, modtimeFile)
+		touchFile(tf)
+		vf := filepath.Join(path, versionFile)
+		if pv != "" {
+			ioutil.WriteFile(vf, []byte(pv), 0644)
+		} else {
+			os.Remove(vf)
+		}
+		return nil
+	})
+
+	return pkgPath, nil
+}
 
-	// Figure out where its root is. The root is the highest level that still has
-	// a ".vcs" subdirectory.
-	root := pkgPath
+// fetchEnv returns the environment the go tool runs with when
+// fetching into the GOPATH src directory src, as picked by
+// packageRoot. With several GOPATH entries, src's is moved first, so
+// that's where go get writes.
+func fetchEnv(src string) []string {
+	env := os.Environ()
+	if len(goPathSrcs) < 2 {
+		return env
+	}
+	gopath := []string{filepath.Dir(src)}
+	for _, s := range goPathSrcs {
+		if s != src {
+			gopath = append(gopath, filepath.Dir(s))
+		}
+	}
+	for i, kv := range env {
+		if strings.HasPrefix(kv, "GOPATH=") {
+			env = append(env[:i:i], env[i+1:]...)
+			break
+		}
+	}
+	return append(env, "GOPATH="+strings.Join(gopath, string(filepath.ListSeparator)))
+}
+
+// vcsRoot returns the root of the checkout containing dir, and which
+// VCS it's from: "git", "hg", "bzr" or "svn".
+func vcsRoot(dir string) (root, vcs string, err error) {
+	// The root is the highest level that still has a ".vcs" subdirectory.
+	root = dir
 	svnSeen := false
 	for checkDir := root; ; {
 		dirHas := func(vcsDir string) bool {
@@ -148,34 +547,20 @@ func getPackage(pkg string) (pkgPath string, err error) {
 			// Keep going up until we *don't* see an .svn directory.
 			svnSeen = true
 		} else if svnSeen {
-			break
+			return root, "svn", nil
 		}
 		root = checkDir
-		if dirHas(".hg") || dirHas(".git") || dirHas(".bzr") {
-			break
+		for _, v := range []string{"hg", "git", "bzr"} {
+			if dirHas("." + v) {
+				return root, v, nil
+			}
 		}
 		checkDir = filepath.Join(checkDir, "..")
 		if checkDir == root {
 			// No change?
-			return "", errors.New("confused; vcs file in root?")
+			return "", "", errors.New("confused; vcs file in root?")
 		}
 	}
-
-	log.Printf("root of %q is: %q", pkg, root)
-	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
-		if err != nil || !fi.IsDir() {
-			return nil
-		}
-		switch filepath.Base(path) {
-		case ".svn", ".hg", ".git", ".bzr":
-			return filepath.SkipDir
-		}
-		tf := filepath.Join(path, modtimeFile)
-		touchFile(tf)
-		return nil
-	})
-
-	return pkgPath, nil
 }
 
 func touchFile(name string) {
@@ -189,6 +574,42 @@ func touchFile(name string) {
 func main() {
 	flag.Parse()
 
+	switch *caseMismatch {
+	case "serve", "error":
+	default:
+		log.Fatalf("invalid -case-mismatch %q; want 'serve' or 'error'", *caseMismatch)
+	}
+	switch *gopathPrecedence {
+	case "order", "fresh":
+	default:
+		log.Fatalf("invalid -gopath-precedence %q; want 'order' or 'fresh'", *gopathPrecedence)
+	}
+	if *compressorCmd != "" {
+		args := strings.Fields(*compressorCmd)
+		if len(args) == 0 {
+			log.Fatalf("empty -compressor-cmd")
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			log.Fatalf("-compressor-cmd: %v", err)
+		}
+	}
+	if *packageShare <= 0 || *packageShare > 1 {
+		log.Fatalf("invalid -max-package-share %v; want a fraction in (0, 1]", *packageShare)
+	}
+
+	if *maxDownloads > 0 {
+		downloadSem = make(chan bool, *maxDownloads)
+	}
+	expvar.Publish("downloads_max", expvar.Func(func() interface{} { return *maxDownloads }))
+	expvar.Publish("downloads_max_per_package", expvar.Func(func() interface{} { return packageDownloadLimit() }))
+	publishLoad("package_downloads", pkgDownloads)
+	publishLoad("package_fetches", pkgFetches)
+	publishLoad("package_fetch_waiters", pkgFetchWaiters)
+
+	if *canaryPackage != "" {
+		go runCanaries()
+	}
+
 	var ln net.Listener
 	addr := *listen
 	if strings.HasPrefix(addr, "envfd:") {
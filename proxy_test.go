@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testGOPATH points the proxy at new GOPATH roots for the duration of
+// the test, returning their src directories.
+func testGOPATH(t *testing.T, n int) []string {
+	t.Helper()
+	old := goPathSrcs
+	t.Cleanup(func() { goPathSrcs = old })
+	goPathSrcs = nil
+	for i := 0; i < n; i++ {
+		goPathSrcs = append(goPathSrcs, filepath.Join(t.TempDir(), "src"))
+	}
+	return goPathSrcs
+}
+
+// freshPackage creates pkg under src with the given files, marked as
+// just fetched so no go get runs.
+func freshPackage(t *testing.T, src, pkg string, files map[string]string) string {
+	t.Helper()
+	dir := filepath.Join(src, filepath.FromSlash(pkg))
+	writeFiles(t, dir, files)
+	touchFile(filepath.Join(dir, modtimeFile))
+	return dir
+}
+
+func get(t *testing.T, url string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	proxy(w, httptest.NewRequest("GET", url, nil))
+	return w
+}
+
+func TestCLevel(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	freshPackage(t, src, "ex/p", map[string]string{
+		"p.go": string(bytes.Repeat([]byte("package p // compressible\n"), 200)),
+	})
+
+	bodies := make(map[string][]byte)
+	for _, clevel := range []string{"", "1", "9", "99", "-2", "-100"} {
+		w := get(t, "/ex/p?clevel="+clevel)
+		if w.Code != 200 {
+			t.Fatalf("clevel=%q: got %d: %s", clevel, w.Code, w.Body)
+		}
+		bodies[clevel] = w.Body.Bytes()
+		zr, err := gzip.NewReader(bytes.NewReader(bodies[clevel]))
+		if err != nil {
+			t.Fatalf("clevel=%q: %v", clevel, err)
+		}
+		if ents := readTar(t, zr); len(ents) != 1 || ents[0].hdr.Name != "p.go" {
+			t.Errorf("clevel=%q: got %d entries", clevel, len(ents))
+		}
+	}
+	if len(bodies["1"]) <= len(bodies["9"]) {
+		t.Errorf("clevel=1 gave %d bytes, clevel=9 %d; want level 1 larger", len(bodies["1"]), len(bodies["9"]))
+	}
+	if !bytes.Equal(bodies["99"], bodies["9"]) {
+		t.Error("clevel=99 not clamped to 9")
+	}
+	if !bytes.Equal(bodies["-100"], bodies["-2"]) {
+		t.Error("clevel=-100 not clamped to -2")
+	}
+
+	for _, clevel := range []string{"x", "1.5", "9x"} {
+		if w := get(t, "/ex/p?clevel="+clevel); w.Code != 400 {
+			t.Errorf("clevel=%q: got %d; want 400", clevel, w.Code)
+		}
+	}
+}
+
+func TestClampGzipLevel(t *testing.T) {
+	for in, want := range map[int]int{-100: -2, -2: -2, -1: -1, 0: 0, 5: 5, 9: 9, 10: 9} {
+		if got := clampGzipLevel(in); got != want {
+			t.Errorf("clampGzipLevel(%d) = %d; want %d", in, got, want)
+		}
+	}
+}
+
+// testDownloadSlots sets -max-downloads and -max-package-share for
+// the duration of the test.
+func testDownloadSlots(t *testing.T, max int, share string) {
+	t.Helper()
+	setFlag(t, "max-downloads", strconv.Itoa(max))
+	setFlag(t, "max-package-share", share)
+	old := downloadSem
+	downloadSem = nil
+	if max > 0 {
+		downloadSem = make(chan bool, max)
+	}
+	t.Cleanup(func() { downloadSem = old })
+}
+
+func TestPackageDownloadLimitUnlimited(t *testing.T) {
+	testDownloadSlots(t, 0, "1")
+	if n := packageDownloadLimit(); n != 0 {
+		t.Errorf("packageDownloadLimit with -max-downloads=0 = %d; want 0", n)
+	}
+}
+
+func TestPackageDownloadShare(t *testing.T) {
+	testDownloadSlots(t, 4, "0.5")
+	if n := packageDownloadLimit(); n != 2 {
+		t.Fatalf("packageDownloadLimit = %d; want 2", n)
+	}
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, ok := acquireDownload("ex/hot")
+		if !ok {
+			t.Fatalf("hot download %d refused", i)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := acquireDownload("ex/hot"); ok {
+		t.Fatal("hot package got a third slot")
+	}
+	for _, pkg := range []string{"ex/cold1", "ex/cold2"} {
+		release, ok := acquireDownload(pkg)
+		if !ok {
+			t.Fatalf("%s refused while hot package is at its share", pkg)
+		}
+		releases = append(releases, release)
+	}
+	if _, ok := acquireDownload("ex/cold3"); ok {
+		t.Fatal("got a fifth slot of four")
+	}
+	for _, release := range releases {
+		release()
+	}
+	if len(downloadSem) != 0 || len(pkgDownloads) != 0 {
+		t.Errorf("after release: %d slots held, load %v", len(downloadSem), pkgDownloads)
+	}
+}
+
+// TestHotPackageStress has many clients hammer one package while a
+// few fetch cold ones, and checks the cold ones all get served.
+func TestHotPackageStress(t *testing.T) {
+	testDownloadSlots(t, 4, "0.5")
+	stop := make(chan bool)
+	var hot sync.WaitGroup
+	var hotMax int32
+	for i := 0; i < 20; i++ {
+		hot.Add(1)
+		go func() {
+			defer hot.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				release, ok := acquireDownload("ex/hot")
+				if !ok {
+					runtime.Gosched()
+					continue
+				}
+				loadMu.Lock()
+				if n := int32(pkgDownloads["ex/hot"]); n > atomic.LoadInt32(&hotMax) {
+					atomic.StoreInt32(&hotMax, n)
+				}
+				loadMu.Unlock()
+				time.Sleep(100 * time.Microsecond)
+				release()
+			}
+		}()
+	}
+
+	var cold sync.WaitGroup
+	served := make([]int32, 3)
+	for i := range served {
+		cold.Add(1)
+		go func(i int) {
+			defer cold.Done()
+			pkg := fmt.Sprintf("ex/cold%d", i)
+			for try := 0; try < 50; try++ {
+				if release, ok := acquireDownload(pkg); ok {
+					atomic.AddInt32(&served[i], 1)
+					time.Sleep(100 * time.Microsecond)
+					release()
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}(i)
+	}
+	cold.Wait()
+	close(stop)
+	hot.Wait()
+
+	if hotMax > 2 {
+		t.Errorf("hot package held %d slots; share allows 2", hotMax)
+	}
+	for i, n := range served {
+		// Two slots are always beyond the hot package's reach, and
+		// only three cold clients share them, so most tries succeed.
+		if n < 10 {
+			t.Errorf("cold package %d served %d of 50 tries", i, n)
+		}
+	}
+}
+
+func TestLocatePackageCase(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	exact := freshPackage(t, src, "ex/exact", map[string]string{"a.go": "package exact\n"})
+	mid := freshPackage(t, src, "Ex/Mid/sub", map[string]string{"a.go": "package sub\n"})
+	tests := []struct {
+		pkg, want string
+	}{
+		{"ex/exact", exact},
+		{"EX/EXACT", exact},
+		{"ex/mid/sub", mid}, // only intermediate elements differ
+		{"Ex/mid/sub", mid},
+		{"ex/missing", filepath.Join(src, "ex", "missing")},
+		{"ex/mid/missing", filepath.Join(src, "ex", "mid", "missing")},
+	}
+	for _, tt := range tests {
+		if got := locatePackage(src, tt.pkg); got != tt.want {
+			t.Errorf("locatePackage(%q) = %q; want %q", tt.pkg, got, tt.want)
+		}
+	}
+}
+
+func TestCaseMismatch(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	freshPackage(t, src, "Ex/Mid/sub", map[string]string{"a.go": "package sub\n"})
+
+	w := get(t, "/Ex/Mid/sub")
+	if w.Code != 200 || w.Header().Get("Warning") != "" {
+		t.Errorf("exact casing: got %d, Warning %q; want 200 and none", w.Code, w.Header().Get("Warning"))
+	}
+
+	setFlag(t, "case-mismatch", "serve")
+	w = get(t, "/ex/mid/sub")
+	if w.Code != 200 {
+		t.Fatalf("serve: got %d: %s", w.Code, w.Body)
+	}
+	if warn := w.Header().Get("Warning"); !strings.HasPrefix(warn, "299 ") || !strings.Contains(warn, "Ex/Mid/sub") {
+		t.Errorf("serve: Warning %q; want a 299 naming Ex/Mid/sub", warn)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ents := readTar(t, zr); len(ents) != 1 || string(ents[0].body) != "package sub\n" {
+		t.Errorf("serve: wrong tar contents %v", ents)
+	}
+
+	setFlag(t, "case-mismatch", "error")
+	w = get(t, "/ex/mid/sub")
+	if w.Code != 404 || !strings.Contains(w.Body.String(), `"Ex/Mid/sub"`) {
+		t.Errorf("error: got %d %q; want 404 naming the canonical casing", w.Code, w.Body)
+	}
+}
+
+func TestCompressorResponse(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	freshPackage(t, src, "ex/p", map[string]string{"p.go": "package p\n"})
+
+	setFlag(t, "compressor-cmd", "gzip -1")
+	setFlag(t, "compressor-encoding", "gzip")
+	w := get(t, "/ex/p")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/x-tar" || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("got %d, Content-Type %q, Content-Encoding %q", w.Code, w.Header().Get("Content-Type"), w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ents := readTar(t, zr); len(ents) != 1 {
+		t.Errorf("got %d entries; want 1", len(ents))
+	}
+
+	setFlag(t, "compressor-encoding", "")
+	setFlag(t, "compressor-content-type", "application/gzip")
+	if w := get(t, "/ex/p"); w.Header().Get("Content-Type") != "application/gzip" || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("got Content-Type %q, Content-Encoding %q", w.Header().Get("Content-Type"), w.Header().Get("Content-Encoding"))
+	}
+
+	if w := get(t, "/ex/p?clevel=1"); w.Code != 400 {
+		t.Errorf("clevel with compressor: got %d; want 400", w.Code)
+	}
+
+	setFlag(t, "compressor-cmd", "nonexistent-go-get-proxy-cmd -9")
+	setFlag(t, "compressor-encoding", "xz")
+	w = get(t, "/ex/p")
+	if w.Code != 500 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("unstartable compressor: got %d, Content-Encoding %q; want 500 and none", w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestMaxDownloadsRejects(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	freshPackage(t, src, "ex/p", map[string]string{"p.go": "package p\n"})
+	testDownloadSlots(t, 1, "1")
+
+	downloadSem <- true // another download holds the only slot
+	before := rejectedDownloads.Value()
+	w := get(t, "/ex/p")
+	if w.Code != 503 {
+		t.Errorf("got %d; want 503", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	if got := rejectedDownloads.Value() - before; got != 1 {
+		t.Errorf("downloads_rejected rose by %d; want 1", got)
+	}
+
+	<-downloadSem
+	if w := get(t, "/ex/p"); w.Code != 200 {
+		t.Errorf("with a free slot: got %d; want 200", w.Code)
+	}
+	if got := rejectedDownloads.Value() - before; got != 1 {
+		t.Errorf("downloads_rejected rose by %d after a served download; want 1", got)
+	}
+}
@@ -4,15 +4,39 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
+var (
+	gzipLevel             = flag.Int("gzip-level", gzip.DefaultCompression, "default gzip level for served tars; overridden per request by ?clevel=")
+	compressorCmd         = flag.String("compressor-cmd", "", "if non-empty, a command (e.g. 'xz -9') that served tars are piped through instead of being gzipped; runs one process per download")
+	compressorEncoding    = flag.String("compressor-encoding", "", "Content-Encoding of -compressor-cmd's output, if any")
+	compressorContentType = flag.String("compressor-content-type", "", "Content-Type of -compressor-cmd's output (e.g. 'application/x-xz'); if empty, application/x-tar, which suits a Content-Encoding")
+	compressorTimeout     = flag.Duration("compressor-timeout", 5*time.Minute, "maximum run time of a -compressor-cmd process")
+	maxTarEntries         = flag.Int("max-tar-entries", 0, "maximum number of files served for a package; larger packages get 413. 0 means no limit")
+	normalizeEOL          = flag.Bool("normalize-eol", false, "convert CRLF line endings to LF in text files served in tars")
+	withChecksums         = flag.Bool("with-checksums", false, "add a "+checksumsFile+" manifest of the archived files to served tars")
+)
+
+// checksumsFile is the name of the manifest added by -with-checksums,
+// in the format read by "sha256sum -c".
+const checksumsFile = "SHA256SUMS"
+
 // sysStat, if non-nil, populates h from system-dependent fields of fi.
 var sysStat func(fi os.FileInfo, h *tar.Header) error
 
@@ -74,10 +98,34 @@ func tarFileInfoHeader(fi os.FileInfo, filename string) (*tar.Header, error) {
 	return h, nil
 }
 
-func makeTar(w io.Writer, workdir string) error {
-	zout := gzip.NewWriter(w)
-	tw := tar.NewWriter(zout)
+// clampGzipLevel returns level limited to the range gzip accepts.
+func clampGzipLevel(level int) int {
+	if level < gzip.HuffmanOnly {
+		return gzip.HuffmanOnly
+	}
+	if level > gzip.BestCompression {
+		return gzip.BestCompression
+	}
+	return level
+}
+
+// A packageFile is a file served as part of a package.
+type packageFile struct {
+	name string // slash-separated, relative to the package dir
+	path string // on disk
+	fi   os.FileInfo
+}
 
+// errTooManyEntries is returned by packageFiles for packages with
+// more than -max-tar-entries files.
+var errTooManyEntries = errors.New("package has too many files")
+
+// packageFiles returns the files of the package in workdir that are
+// served: its top-level files, minus the proxy's marker file and any
+// that are too large. The walk stops early with errTooManyEntries if
+// there are more than -max-tar-entries of them.
+func packageFiles(workdir string) ([]packageFile, error) {
+	var files []packageFile
 	err := filepath.Walk(workdir, filepath.WalkFunc(func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			log.Printf("Error walking path %q: %v", path, err)
@@ -95,7 +143,7 @@ func makeTar(w io.Writer, workdir string) error {
 		if strings.HasPrefix(name, "/") {
 			name = name[1:]
 		}
-		if name == modtimeFile {
+		if name == modtimeFile || name == versionFile {
 			return nil
 		}
 
@@ -116,6 +164,109 @@ func makeTar(w io.Writer, workdir string) error {
 			return nil
 		}
 
+		if *maxTarEntries > 0 && len(files) >= *maxTarEntries {
+			return errTooManyEntries
+		}
+		files = append(files, packageFile{name: name, path: path, fi: fi})
+		return nil
+	}))
+	return files, err
+}
+
+// readPackageFile returns the contents of path as served, with line
+// endings normalized if -normalize-eol is set.
+func readPackageFile(path string) ([]byte, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if *normalizeEOL && !isBinary(body) {
+		body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	}
+	return body, nil
+}
+
+// tarFiles returns the files to tar for the package in workdir. With
+// -with-checksums, the manifest counts toward -max-tar-entries.
+func tarFiles(workdir string) ([]packageFile, error) {
+	files, err := packageFiles(workdir)
+	if err != nil || !*withChecksums || *maxTarEntries <= 0 {
+		return files, err
+	}
+	n := 1 // the manifest
+	for _, f := range files {
+		if f.name != checksumsFile {
+			n++
+		}
+	}
+	if n > *maxTarEntries {
+		return nil, errTooManyEntries
+	}
+	return files, nil
+}
+
+// makeTar writes a gzipped tar of workdir's top-level files to w,
+// compressed at the given gzip level.
+func makeTar(w io.Writer, workdir string, level int) error {
+	files, err := tarFiles(workdir)
+	if err != nil {
+		return err
+	}
+	zout, err := gzip.NewWriterLevel(w, clampGzipLevel(level))
+	if err != nil {
+		return err
+	}
+	if err := writeTar(zout, files); err != nil {
+		return err
+	}
+	return zout.Close()
+}
+
+// makeTarCmd writes a tar of workdir's top-level files to w,
+// compressed by piping it through -compressor-cmd. The command is
+// killed if ctx is done first.
+func makeTarCmd(ctx context.Context, w io.Writer, workdir string) error {
+	files, err := tarFiles(workdir)
+	if err != nil {
+		return err
+	}
+	args := strings.Fields(*compressorCmd)
+	ctx, cancel := context.WithTimeout(ctx, *compressorTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Error starting %s: %v", *compressorCmd, err)
+	}
+	tarErr := writeTar(in, files)
+	in.Close()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v; stderr: %s", *compressorCmd, err, stderr.Bytes())
+	}
+	return tarErr
+}
+
+// writeTar writes an uncompressed tar of files to w.
+func writeTar(w io.Writer, files []packageFile) error {
+	tw := tar.NewWriter(w)
+
+	sums := make(map[string][]byte) // archived name -> sha256
+	var sumsModTime time.Time
+
+	add := func(f packageFile) error {
+		name, path, fi := f.name, f.path, f.fi
+		if *withChecksums && name == checksumsFile {
+			// Would collide with the manifest we add.
+			log.Printf("Omitting package's own %s from tar of %q; -with-checksums replaces it", checksumsFile, path)
+			return nil
+		}
+
 		hdr, err := tarFileInfoHeader(fi, path)
 		if err != nil {
 			log.Printf("error making header of %q: %v", path, err)
@@ -134,6 +285,31 @@ func makeTar(w io.Writer, workdir string) error {
 			hdr.Mode = hdr.Mode&^0777 | 0644
 		}
 
+		var dst io.Writer = tw
+		if *withChecksums && hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			dst = io.MultiWriter(tw, h)
+			defer func() { sums[name] = h.Sum(nil) }()
+			if hdr.ModTime.After(sumsModTime) {
+				sumsModTime = hdr.ModTime
+			}
+		}
+
+		if *normalizeEOL && hdr.Typeflag == tar.TypeReg {
+			body, err := readPackageFile(path)
+			if err != nil {
+				log.Printf("ReadFile: %v", err)
+				return err
+			}
+			hdr.Size = int64(len(body))
+			if err := tw.WriteHeader(hdr); err != nil {
+				log.Printf("WriteHeader: %v", err)
+				return fmt.Errorf("Error writing file %q: %v", name, err)
+			}
+			_, err = dst.Write(body)
+			return err
+		}
+
 		err = tw.WriteHeader(hdr)
 		if err != nil {
 			log.Printf("WriteHeader: %v", err)
@@ -145,18 +321,58 @@ func makeTar(w io.Writer, workdir string) error {
 			return err
 		}
 		defer r.Close()
-		_, err = io.Copy(tw, r)
-		return err
-	}))
-	if err != nil {
+		_, err = io.Copy(dst, r)
 		return err
 	}
+	for _, f := range files {
+		if err := add(f); err != nil {
+			return err
+		}
+	}
 
-	if err := tw.Close(); err != nil {
-		return err
+	if *withChecksums {
+		if err := writeChecksums(tw, sums, sumsModTime); err != nil {
+			return err
+		}
 	}
-	if err := zout.Close(); err != nil {
-		return err
+
+	return tw.Close()
+}
+
+// isBinary reports whether b looks like binary data, using the same
+// heuristic as git: a NUL byte within the first 8000 bytes.
+func isBinary(b []byte) bool {
+	if len(b) > 8000 {
+		b = b[:8000]
+	}
+	return bytes.IndexByte(b, 0) >= 0
+}
+
+// writeChecksums adds the -with-checksums manifest to tw, sorted by
+// name so it's stable for a given revision. The manifest's modtime is
+// that of the newest archived file.
+func writeChecksums(tw *tar.Writer, sums map[string][]byte, modTime time.Time) error {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%x  %s\n", sums[name], name)
+	}
+	hdr := &tar.Header{
+		Name:     checksumsFile,
+		Mode:     0644 | c_ISREG,
+		Typeflag: tar.TypeReg,
+		Size:     int64(buf.Len()),
+		ModTime:  modTime,
+		Uname:    "root",
+		Gname:    "root",
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Error writing file %q: %v", checksumsFile, err)
 	}
-	return nil
+	_, err := tw.Write(buf.Bytes())
+	return err
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates dir containing the given files.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type tarEntry struct {
+	hdr  *tar.Header
+	body []byte
+}
+
+// readTar returns the entries of the uncompressed tar r, in order.
+func readTar(t *testing.T, r io.Reader) []tarEntry {
+	t.Helper()
+	var ents []tarEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return ents
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ents = append(ents, tarEntry{hdr, body})
+	}
+}
+
+// makeTestTar returns the entries of makeTar's output for dir.
+func makeTestTar(t *testing.T, dir string) []tarEntry {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := makeTar(&buf, dir, *gzipLevel); err != nil {
+		t.Fatalf("makeTar: %v", err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readTar(t, zr)
+}
+
+// setFlag sets the named flag for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+func TestNormalizeEOL(t *testing.T) {
+	dir := t.TempDir()
+	bin := "x\r\n\x00y\r\n"
+	writeFiles(t, dir, map[string]string{
+		"a.go":  "package a\r\n\r\nfunc A() {}\r\n",
+		"b.bin": bin,
+		"c.txt": "no crlf\n",
+	})
+	want := map[string]string{
+		"a.go":  "package a\n\nfunc A() {}\n",
+		"b.bin": bin,
+		"c.txt": "no crlf\n",
+	}
+
+	setFlag(t, "normalize-eol", "true")
+	ents := makeTestTar(t, dir)
+	if len(ents) != len(want) {
+		t.Fatalf("got %d entries; want %d", len(ents), len(want))
+	}
+	for _, e := range ents {
+		if string(e.body) != want[e.hdr.Name] {
+			t.Errorf("%s = %q; want %q", e.hdr.Name, e.body, want[e.hdr.Name])
+		}
+		if e.hdr.Size != int64(len(e.body)) {
+			t.Errorf("%s: header size %d; body is %d bytes", e.hdr.Name, e.hdr.Size, len(e.body))
+		}
+	}
+
+	setFlag(t, "normalize-eol", "false")
+	for _, e := range makeTestTar(t, dir) {
+		if e.hdr.Name == "a.go" && !bytes.Contains(e.body, []byte("\r\n")) {
+			t.Errorf("without -normalize-eol, a.go = %q; want CRLF kept", e.body)
+		}
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	if isBinary([]byte("hello\r\n")) {
+		t.Error("text reported as binary")
+	}
+	if !isBinary([]byte("a\x00b")) {
+		t.Error("NUL not reported as binary")
+	}
+	late := append(bytes.Repeat([]byte("a"), 9000), 0)
+	if isBinary(late) {
+		t.Error("NUL past 8000 bytes reported as binary")
+	}
+}
+
+func TestWithChecksums(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.go":        "package a\n",
+		"b.go":        "package a // b\n",
+		"README":      "readme\n",
+		checksumsFile: "the package's own, to be replaced\n",
+		modtimeFile:   "",
+	})
+	setFlag(t, "with-checksums", "true")
+	ents := makeTestTar(t, dir)
+
+	last := ents[len(ents)-1]
+	if last.hdr.Name != checksumsFile {
+		t.Fatalf("last entry is %q; want %q", last.hdr.Name, checksumsFile)
+	}
+	archived := make(map[string][]byte)
+	for _, e := range ents[:len(ents)-1] {
+		if e.hdr.Name == checksumsFile {
+			t.Errorf("package's own %s archived too", checksumsFile)
+		}
+		archived[e.hdr.Name] = e.body
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(last.body), "\n"), "\n")
+	if len(lines) != len(archived) {
+		t.Errorf("manifest has %d lines; archived %d files:\n%s", len(lines), len(archived), last.body)
+	}
+	var names []string
+	for _, line := range lines {
+		f := strings.SplitN(line, "  ", 2)
+		if len(f) != 2 {
+			t.Fatalf("bad manifest line %q", line)
+		}
+		sum, name := f[0], f[1]
+		names = append(names, name)
+		if name == checksumsFile {
+			t.Errorf("manifest lists itself")
+			continue
+		}
+		body, ok := archived[name]
+		if !ok {
+			t.Errorf("manifest lists %q, which isn't archived", name)
+			continue
+		}
+		if want := fmt.Sprintf("%x", sha256.Sum256(body)); sum != want {
+			t.Errorf("%s: manifest sum %s; archived content's is %s", name, sum, want)
+		}
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("manifest not sorted: %q", names)
+	}
+}
+
+func TestMakeTarCmd(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.go": "package a\n", "b.go": "package a // b\n"})
+
+	for _, tt := range []struct {
+		cmd    string
+		decode func(io.Reader) (io.Reader, error)
+	}{
+		{"cat", func(r io.Reader) (io.Reader, error) { return r, nil }},
+		{"gzip -1", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	} {
+		setFlag(t, "compressor-cmd", tt.cmd)
+		var buf bytes.Buffer
+		if err := makeTarCmd(context.Background(), &buf, dir); err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		r, err := tt.decode(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		ents := readTar(t, r)
+		if len(ents) != 2 || ents[0].hdr.Name != "a.go" || string(ents[1].body) != "package a // b\n" {
+			t.Errorf("%s: got %d entries: %v", tt.cmd, len(ents), ents)
+		}
+	}
+}
+
+func TestMakeTarCmdFails(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.go": "package a\n"})
+	for _, cmd := range []string{"nonexistent-go-get-proxy-cmd -9", "false"} {
+		setFlag(t, "compressor-cmd", cmd)
+		if err := makeTarCmd(context.Background(), ioutil.Discard, dir); err == nil {
+			t.Errorf("%s: no error", cmd)
+		}
+	}
+}
+
+func TestMaxTarEntries(t *testing.T) {
+	dir := t.TempDir()
+	files := make(map[string]string)
+	for i := 0; i < 5000; i++ {
+		files[fmt.Sprintf("f%04d.go", i)] = "package p\n"
+	}
+	writeFiles(t, dir, files)
+
+	setFlag(t, "max-tar-entries", "1000")
+	if err := makeTar(ioutil.Discard, dir, *gzipLevel); err != errTooManyEntries {
+		t.Errorf("5000 files, cap 1000: got %v; want errTooManyEntries", err)
+	}
+	setFlag(t, "max-tar-entries", "5000")
+	if ents := makeTestTar(t, dir); len(ents) != 5000 {
+		t.Errorf("at the cap: got %d entries; want 5000", len(ents))
+	}
+
+	// The manifest is an entry too.
+	setFlag(t, "with-checksums", "true")
+	if err := makeTar(ioutil.Discard, dir, *gzipLevel); err != errTooManyEntries {
+		t.Errorf("5000 files plus manifest, cap 5000: got %v; want errTooManyEntries", err)
+	}
+	setFlag(t, "max-tar-entries", "5001")
+	if ents := makeTestTar(t, dir); len(ents) != 5001 {
+		t.Errorf("with manifest: got %d entries; want 5001", len(ents))
+	}
+}
+
+func TestMaxTarEntriesResponse(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	files := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("f%03d.go", i)] = "package p\n"
+	}
+	freshPackage(t, src, "ex/many", files)
+	setFlag(t, "max-tar-entries", "10")
+	for _, url := range []string{"/ex/many", "/ex/many?format=filesmap"} {
+		if w := get(t, url); w.Code != 413 {
+			t.Errorf("%s: got %d; want 413", url, w.Code)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pseudoVersion returns a Go module style pseudo-version,
+// v0.0.0-yyyymmddhhmmss-abcdefabcdef, for the revision checked out in
+// the given root, or "" if it's tagged or the VCS can't say. git and
+// hg use the commit hash. svn and bzr have none, so their revision
+// number, zero-padded to 12 digits, stands in for it.
+func pseudoVersion(root, vcs string) string {
+	var cmd *exec.Cmd
+	switch vcs {
+	case "git":
+		tag := exec.Command("git", "describe", "--exact-match", "--tags", "HEAD")
+		tag.Dir = root
+		if tag.Run() == nil {
+			return ""
+		}
+		cmd = exec.Command("git", "log", "-1", "--format=%ct %H")
+	case "hg":
+		cmd = exec.Command("hg", "log", "-r", ".", "--template", "{date|hgdate} {node} {tags}")
+	case "svn":
+		cmd = exec.Command("svn", "info")
+	case "bzr":
+		cmd = exec.Command("bzr", "version-info")
+	default:
+		return ""
+	}
+	cmd.Dir = root
+	out, err := cmd.Output()
+	if err != nil {
+		log.Printf("Error getting revision of %q: %v", root, err)
+		return ""
+	}
+	switch vcs {
+	case "git":
+		return pseudoVersionGit(out)
+	case "hg":
+		return pseudoVersionHg(out)
+	case "svn":
+		return pseudoVersionInfo(out, "Last Changed Date", "Last Changed Rev")
+	default:
+		return pseudoVersionInfo(out, "date", "revno")
+	}
+}
+
+// formatPseudoVersion returns the pseudo-version for a revision made
+// at t, identified by rev, which is 12 characters long.
+func formatPseudoVersion(t time.Time, rev string) string {
+	return fmt.Sprintf("v0.0.0-%s-%s", t.UTC().Format("20060102150405"), rev)
+}
+
+// pseudoVersionGit parses the output of git log --format="%ct %H".
+func pseudoVersionGit(out []byte) string {
+	f := strings.Fields(string(out))
+	if len(f) != 2 {
+		return ""
+	}
+	return pseudoVersionHash(f[0], f[1])
+}
+
+// pseudoVersionHg parses the output of hg log with the template
+// "{date|hgdate} {node} {tags}": unixtime tzoffset node tags...
+func pseudoVersionHg(out []byte) string {
+	f := strings.Fields(string(out))
+	if len(f) < 3 {
+		return ""
+	}
+	for _, t := range f[3:] {
+		// hg always tags its newest commit "tip".
+		if t != "tip" {
+			return ""
+		}
+	}
+	return pseudoVersionHash(f[0], f[2])
+}
+
+func pseudoVersionHash(unix, hash string) string {
+	sec, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil || len(hash) < 12 {
+		return ""
+	}
+	return formatPseudoVersion(time.Unix(sec, 0), hash[:12])
+}
+
+// pseudoVersionInfo parses "key: value" lines, as printed by svn info
+// and bzr version-info, taking the revision's date and number from
+// the named keys. Both print dates as "2006-01-02 15:04:05 -0700",
+// svn with more after.
+func pseudoVersionInfo(out []byte, dateKey, revKey string) string {
+	var date, rev string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		i := strings.Index(s.Text(), ": ")
+		if i < 0 {
+			continue
+		}
+		switch k, v := s.Text()[:i], strings.TrimSpace(s.Text()[i+2:]); k {
+		case dateKey:
+			date = v
+		case revKey:
+			rev = v
+		}
+	}
+	const layout = "2006-01-02 15:04:05 -0700"
+	if len(date) < len(layout) {
+		return ""
+	}
+	t, err := time.Parse(layout, date[:len(layout)])
+	if err != nil {
+		return ""
+	}
+	n, err := strconv.ParseUint(rev, 10, 64)
+	if err != nil {
+		return ""
+	}
+	return formatPseudoVersion(t, fmt.Sprintf("%012d", n))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"compress/gzip"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var pseudoVersionRE = regexp.MustCompile(`^v0\.0\.0-[0-9]{14}-[0-9a-f]{12}$`)
+
+func TestFormatPseudoVersion(t *testing.T) {
+	tm := time.Date(2017, 3, 4, 5, 6, 7, 0, time.FixedZone("X", -7*3600))
+	got := formatPseudoVersion(tm, "0123456789ab")
+	if want := "v0.0.0-20170304120607-0123456789ab"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if !pseudoVersionRE.MatchString(got) {
+		t.Errorf("%q doesn't match %v", got, pseudoVersionRE)
+	}
+}
+
+func TestPseudoVersionParse(t *testing.T) {
+	tests := []struct {
+		name, got, want string
+	}{
+		{"git", pseudoVersionGit([]byte("1488603967 0123456789abcdef0123456789abcdef01234567\n")), "v0.0.0-20170304050607-0123456789ab"},
+		{"git short", pseudoVersionGit([]byte("1488603967 0123\n")), ""},
+		{"hg tip", pseudoVersionHg([]byte("1488603967 0 0123456789abcdef0123456789abcdef01234567 tip")), "v0.0.0-20170304050607-0123456789ab"},
+		{"hg untagged", pseudoVersionHg([]byte("1488603967 0 0123456789abcdef0123456789abcdef01234567")), "v0.0.0-20170304050607-0123456789ab"},
+		{"hg tagged", pseudoVersionHg([]byte("1488603967 0 0123456789abcdef0123456789abcdef01234567 v1.0 tip")), ""},
+		{"svn", pseudoVersionInfo([]byte("Path: .\nURL: http://example.com/svn/trunk\nRevision: 1234\nLast Changed Author: gopher\nLast Changed Rev: 1230\nLast Changed Date: 2017-03-04 05:06:07 +0100 (Sat, 04 Mar 2017)\n"), "Last Changed Date", "Last Changed Rev"), "v0.0.0-20170304040607-000000001230"},
+		{"bzr", pseudoVersionInfo([]byte("revision-id: gopher@example.com-20170304050607-abc\ndate: 2017-03-04 05:06:07 +0000\nbuild-date: 2018-01-01 00:00:00 +0000\nrevno: 42\nbranch-nick: trunk\n"), "date", "revno"), "v0.0.0-20170304050607-000000000042"},
+		{"bzr dotted revno", pseudoVersionInfo([]byte("date: 2017-03-04 05:06:07 +0000\nrevno: 4.1.2\n"), "date", "revno"), ""},
+		{"svn no date", pseudoVersionInfo([]byte("Last Changed Rev: 1230\n"), "Last Changed Date", "Last Changed Rev"), ""},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, tt.got, tt.want)
+		}
+		if tt.want != "" && !pseudoVersionRE.MatchString(tt.got) {
+			t.Errorf("%s: %q doesn't match %v", tt.name, tt.got, pseudoVersionRE)
+		}
+	}
+}
+
+// gitRepo makes dir a git repo with one commit.
+func gitRepo(t *testing.T, dir string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("no git")
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=gopher", "-c", "user.email=gopher@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+}
+
+func TestPseudoVersionGitRepo(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.go": "package a\n"})
+	gitRepo(t, dir)
+	if pv := pseudoVersion(dir, "git"); !pseudoVersionRE.MatchString(pv) {
+		t.Errorf("untagged: got %q", pv)
+	}
+	tag := exec.Command("git", "tag", "v1.0.0")
+	tag.Dir = dir
+	if err := tag.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if pv := pseudoVersion(dir, "git"); pv != "" {
+		t.Errorf("tagged: got %q; want none", pv)
+	}
+}
+
+// TestPseudoVersionStored checks the pseudo-version is computed at
+// fetch time and served from the stored copy afterwards.
+func TestPseudoVersionStored(t *testing.T) {
+	src := testGOPATH(t, 1)[0]
+	dir := filepath.Join(src, "ex", "g")
+	writeFiles(t, dir, map[string]string{"sub/a.go": "package sub\n"})
+	gitRepo(t, dir)
+	fakeGo(t, "exit 0\n") // the checkout is already there
+
+	w := get(t, "/ex/g/sub")
+	pv := w.Header().Get("X-Pseudo-Version")
+	if w.Code != 200 || !pseudoVersionRE.MatchString(pv) {
+		t.Fatalf("got %d, X-Pseudo-Version %q", w.Code, pv)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range readTar(t, zr) {
+		if e.hdr.Name == versionFile {
+			t.Errorf("%s served in tar", versionFile)
+		}
+	}
+
+	// Fresh now, so no fetch runs; the header comes from the stored
+	// file even with git gone.
+	t.Setenv("PATH", "")
+	if got := get(t, "/ex/g/sub").Header().Get("X-Pseudo-Version"); got != pv {
+		t.Errorf("cached: X-Pseudo-Version %q; want %q", got, pv)
+	}
+}